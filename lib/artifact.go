@@ -0,0 +1,85 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/containers/oci-fetch/lib/schema"
+)
+
+// FetchArtifact downloads the generic OCI artifact represented by u (a
+// Helm chart, a WASM module, an SBOM, a policy bundle, ...) into
+// outputDir, laid out the same way Fetch lays out an image. Unlike Fetch,
+// it doesn't assume the manifest's config is a JSON image config or that
+// its layers are image filesystem layers: manifest.Config.MediaType and
+// each layer's MediaType are treated as opaque and downloaded as-is. It
+// returns the fetched manifest so callers can inspect those media types
+// themselves.
+func (of *OCIFetcher) FetchArtifact(u *URL, outputDir string) (*schema.ImageManifest, error) {
+	if err := os.MkdirAll(blobsDir(outputDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(refsDir(outputDir), 0755); err != nil {
+		return nil, err
+	}
+
+	of.debugMsg("fetching OCI artifact host:%s, name:%s, tag:%s", u.Host, u.Name, u.Version)
+	manifestData, err := of.fetchManifestByReference(u, u.Reference(), outputDir, artifactManifestAccept)
+	if err != nil {
+		return nil, err
+	}
+	manifest := manifestData.manifest
+	of.debugMsg("artifact manifest successfully retrieved")
+
+	configBlob, err := of.fetchBlob(u, manifest.Config.Digest, manifest.Config.Size, manifest.Config.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	of.debugMsg("artifact config successfully retrieved")
+
+	layers := removeDuplicateLayers(manifest.Layers)
+	bf := newBlobFetcher(of)
+	if err := bf.fetchAll(u, layers, outputDir); err != nil {
+		return nil, err
+	}
+	of.debugMsg("artifact layers successfully retrieved")
+
+	if err := writeJSONToFile(filepath.Join(outputDir, "oci-layout"), schema.DefaultOCILayout); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(blobFile(outputDir, manifestData.digest), manifestData.blob, 0644); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(blobFile(outputDir, manifest.Config.Digest), configBlob, 0644); err != nil {
+		return nil, err
+	}
+
+	descriptor := schema.Descriptor{
+		MediaType: manifestData.mediaType,
+		Digest:    manifestData.digest,
+		Size:      manifestData.size,
+	}
+	if err := writeJSONToFile(path.Join(refsDir(outputDir), u.Reference()), descriptor); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
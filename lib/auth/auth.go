@@ -0,0 +1,81 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth resolves registry credentials the way docker and
+// go-containerregistry do: a Keychain maps a registry host to an
+// Authenticator, and the Authenticator hands back the credentials to use
+// for requests against that host.
+package auth
+
+// Config holds the credentials an Authenticator resolved for a registry
+// host, in the terms the registry's token endpoint understands.
+type Config struct {
+	Username string
+	Password string
+	// IdentityToken, when set, is exchanged for a short-lived bearer
+	// token via the OAuth2 refresh_token grant instead of sending
+	// Username/Password to the token endpoint.
+	IdentityToken string
+}
+
+// Authenticator supplies the Config to use to authenticate against a
+// single registry host.
+type Authenticator interface {
+	Authorization() (*Config, error)
+}
+
+type static struct {
+	config Config
+}
+
+func (s static) Authorization() (*Config, error) {
+	return &s.config, nil
+}
+
+// Basic returns an Authenticator that always supplies the given
+// username/password pair.
+func Basic(username, password string) Authenticator {
+	return static{config: Config{Username: username, Password: password}}
+}
+
+type anonymous struct{}
+
+func (anonymous) Authorization() (*Config, error) {
+	return &Config{}, nil
+}
+
+// Anonymous is an Authenticator that supplies no credentials at all, for
+// registries or repositories that don't require auth.
+var Anonymous Authenticator = anonymous{}
+
+// Keychain resolves the Authenticator to use for a given registry host.
+type Keychain interface {
+	Resolve(host string) (Authenticator, error)
+}
+
+type staticKeychain struct {
+	authenticator Authenticator
+}
+
+// NewStaticKeychain returns a Keychain that resolves every host to the same
+// Authenticator, for callers that were given one explicit set of
+// credentials to use everywhere rather than a credential store to look
+// them up in.
+func NewStaticKeychain(a Authenticator) Keychain {
+	return staticKeychain{authenticator: a}
+}
+
+func (k staticKeychain) Resolve(host string) (Authenticator, error) {
+	return k.authenticator, nil
+}
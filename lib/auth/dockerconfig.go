@@ -0,0 +1,189 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerConfig is the subset of ~/.docker/config.json that credential
+// resolution cares about.
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+// dockerConfigAuth is one entry of the config's "auths" map.
+type dockerConfigAuth struct {
+	// Auth is a base64-encoded "username:password" pair.
+	Auth string `json:"auth"`
+	// IdentityToken, when present, takes precedence over Auth: it's an
+	// opaque token minted by an external identity provider that must be
+	// exchanged for a bearer token via the refresh_token grant.
+	IdentityToken string `json:"identitytoken"`
+}
+
+// DockerConfigKeychain resolves credentials the same way the docker CLI
+// does: from the "auths" section of a docker config.json (decoding its
+// base64 "auth" field, or passing through its "identitytoken"), or by
+// invoking the docker-credential-* helper named in "credHelpers" for the
+// host, falling back to "credsStore" for every other host, and finally
+// Anonymous if nothing matches.
+type DockerConfigKeychain struct {
+	path string
+}
+
+// NewDefaultKeychain returns a DockerConfigKeychain reading the docker
+// CLI's config file, at $DOCKER_CONFIG/config.json if set, or
+// ~/.docker/config.json otherwise.
+func NewDefaultKeychain() *DockerConfigKeychain {
+	return &DockerConfigKeychain{path: defaultConfigPath()}
+}
+
+func defaultConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+func (k *DockerConfigKeychain) load() (*dockerConfig, error) {
+	if k.path == "" {
+		return &dockerConfig{}, nil
+	}
+
+	blob, err := ioutil.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		return &dockerConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &dockerConfig{}
+	if err := json.Unmarshal(blob, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", k.path, err)
+	}
+	return cfg, nil
+}
+
+// dockerHubAuthKey is the key docker login stores Docker Hub credentials
+// under in config.json, for historical reasons predating the registry
+// host registry-1.docker.io.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// normalizeHost maps the registry host used to address Docker Hub to the
+// key docker login actually stores its credentials under, so lookups
+// against "auths"/"credHelpers" succeed for the default host added by
+// NewURL. Every other host is looked up as-is.
+func normalizeHost(host string) string {
+	switch host {
+	case "registry-1.docker.io", "docker.io", "index.docker.io":
+		return dockerHubAuthKey
+	}
+	return host
+}
+
+// Resolve implements Keychain.
+func (k *DockerConfigKeychain) Resolve(host string) (Authenticator, error) {
+	cfg, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+
+	host = normalizeHost(host)
+
+	if helper, ok := cfg.CredHelpers[host]; ok {
+		return credHelperAuthenticator(helper, host)
+	}
+
+	if entry, ok := cfg.Auths[host]; ok {
+		return decodeConfigAuth(entry)
+	}
+
+	if cfg.CredsStore != "" {
+		return credHelperAuthenticator(cfg.CredsStore, host)
+	}
+
+	return Anonymous, nil
+}
+
+func decodeConfigAuth(entry dockerConfigAuth) (Authenticator, error) {
+	config := Config{IdentityToken: entry.IdentityToken}
+
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("decoding auth entry: %v", err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("auth entry is not in the form user:password")
+		}
+		config.Username = parts[0]
+		config.Password = parts[1]
+	}
+
+	return static{config: config}, nil
+}
+
+// credHelperOutput is what "docker-credential-<name> get" prints to
+// stdout, per the protocol documented at
+// github.com/docker/docker-credential-helpers.
+type credHelperOutput struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+func credHelperAuthenticator(helper, host string) (Authenticator, error) {
+	creds, err := execCredentialHelper(helper, host)
+	if err != nil {
+		return nil, err
+	}
+	return static{config: Config{Username: creds.Username, Password: creds.Secret}}, nil
+}
+
+func execCredentialHelper(helper, host string) (*credHelperOutput, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("docker-credential-%s get: %v: %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+
+	out := &credHelperOutput{}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return nil, fmt.Errorf("parsing docker-credential-%s output: %v", helper, err)
+	}
+	return out, nil
+}
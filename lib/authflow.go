@@ -0,0 +1,217 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containers/oci-fetch/lib/auth"
+)
+
+// authConfig resolves the credentials to use against host via of.keychain,
+// memoizing the result in of.authCache so that a repeated call - e.g. once
+// per chunk of a chunked blob upload, or once per blob of a concurrent
+// download - doesn't re-read config.json or re-exec a credential helper.
+func (of *OCIFetcher) authConfig(host string) (*auth.Config, error) {
+	of.authCacheMu.Lock()
+	cfg, ok := of.authCache[host]
+	of.authCacheMu.Unlock()
+	if ok {
+		return cfg, nil
+	}
+
+	authenticator, err := of.keychain.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err = authenticator.Authorization()
+	if err != nil {
+		return nil, err
+	}
+
+	of.authCacheMu.Lock()
+	of.authCache[host] = cfg
+	of.authCacheMu.Unlock()
+
+	return cfg, nil
+}
+
+// setBasicAuth sets HTTP Basic auth on req from the credentials resolved
+// for req's host, if any. Registries that require a bearer token instead
+// reject this with a 401 carrying a WWW-Authenticate challenge, which
+// makeRequest handles by calling acquireAuthToken.
+func (of *OCIFetcher) setBasicAuth(req *http.Request) error {
+	authCfg, err := of.authConfig(req.URL.Host)
+	if err != nil {
+		return err
+	}
+	if authCfg.Username != "" || authCfg.Password != "" {
+		req.SetBasicAuth(authCfg.Username, authCfg.Password)
+	}
+	return nil
+}
+
+// acquireAuthToken exchanges challenge, the WWW-Authenticate header
+// returned for repo on host, for a bearer token and caches it in
+// of.hostsV2AuthTokens so the retried request in makeRequest can use it.
+func (of *OCIFetcher) acquireAuthToken(client *http.Client, challenge string, repo string, host string) error {
+	params := parseWWWAuthenticateBearer(challenge)
+	if params == nil || params["realm"] == "" {
+		return fmt.Errorf("unsupported or missing www-authenticate challenge: %s", challenge)
+	}
+
+	authCfg, err := of.authConfig(host)
+	if err != nil {
+		return err
+	}
+
+	token, err := fetchBearerToken(client, params, authCfg)
+	if err != nil {
+		return err
+	}
+
+	if of.hostsV2AuthTokens[host] == nil {
+		of.hostsV2AuthTokens[host] = make(map[string]string)
+	}
+	of.hostsV2AuthTokens[host][repo] = token
+
+	return nil
+}
+
+// parseWWWAuthenticateBearer parses the realm/service/scope parameters out
+// of a "Bearer realm=\"...\",service=\"...\",scope=\"...\"" challenge, as
+// returned by the distribution token authentication spec. It returns nil
+// if challenge isn't a Bearer challenge.
+func parseWWWAuthenticateBearer(challenge string) map[string]string {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(challenge, prefix) {
+		return nil
+	}
+
+	params := make(map[string]string)
+	var lastKey string
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, prefix), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			// a comma inside a quoted value, e.g. scope="repository:foo:pull,push"
+			if lastKey != "" {
+				params[lastKey] += "," + strings.Trim(strings.TrimSpace(part), `"`)
+			}
+			continue
+		}
+		lastKey = kv[0]
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+// bearerTokenResponse covers both the "token" field name used by most
+// registries and the "access_token" used by some OAuth2-style token
+// servers; both are valid per the distribution spec.
+type bearerTokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+func (r bearerTokenResponse) bearer() string {
+	if r.Token != "" {
+		return r.Token
+	}
+	return r.AccessToken
+}
+
+// fetchBearerToken retrieves a bearer token from the auth server described
+// by params (realm, service, scope), using authCfg's identity token if set,
+// or its username/password otherwise.
+func fetchBearerToken(client *http.Client, params map[string]string, authCfg *auth.Config) (string, error) {
+	realm := params["realm"]
+
+	if authCfg.IdentityToken != "" {
+		return refreshBearerToken(client, realm, params["service"], params["scope"], authCfg.IdentityToken)
+	}
+
+	req, err := http.NewRequest("GET", realm, nil)
+	if err != nil {
+		return "", err
+	}
+
+	q := req.URL.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		q.Set("scope", scope)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	if authCfg.Username != "" || authCfg.Password != "" {
+		req.SetBasicAuth(authCfg.Username, authCfg.Password)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	return decodeBearerToken(res)
+}
+
+// refreshBearerToken exchanges a docker config.json identity token for a
+// bearer token via the refresh_token OAuth2 grant, as described in the
+// distribution token authentication spec.
+func refreshBearerToken(client *http.Client, realm, service, scope, identityToken string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", identityToken)
+	form.Set("service", service)
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	form.Set("client_id", "oci-fetch")
+
+	res, err := client.PostForm(realm, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	return decodeBearerToken(res)
+}
+
+func decodeBearerToken(res *http.Response) (string, error) {
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected http code from auth server: %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	tokenResp := bearerTokenResponse{}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.bearer() == "" {
+		return "", fmt.Errorf("auth server response didn't contain a token")
+	}
+	return tokenResp.bearer(), nil
+}
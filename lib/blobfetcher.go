@@ -0,0 +1,274 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/containers/oci-fetch/lib/digest"
+	"github.com/containers/oci-fetch/lib/schema"
+)
+
+const (
+	// defaultMaxConcurrentDownloads is the number of blobs a blobFetcher
+	// downloads in parallel when the caller didn't configure a different
+	// limit via NewOCIFetcher.
+	defaultMaxConcurrentDownloads = 3
+
+	// maxFetchAttempts bounds how many attempts, the first one included,
+	// blobFetcher makes at a blob download before giving up on it.
+	maxFetchAttempts = 5
+
+	// retryBaseDelay is the backoff before the first retry; each further
+	// retry doubles it, plus jitter.
+	retryBaseDelay = 250 * time.Millisecond
+)
+
+// blobFetcher downloads a set of blobs into an output directory. It skips
+// blobs that are already present and verified on disk, resumes partial
+// downloads with Range requests, retries transient failures with
+// exponential backoff, and bounds how many blobs are downloaded at once.
+type blobFetcher struct {
+	of  *OCIFetcher
+	sem chan struct{}
+}
+
+func newBlobFetcher(of *OCIFetcher) *blobFetcher {
+	return &blobFetcher{
+		of:  of,
+		sem: make(chan struct{}, of.maxConcurrentDownloads),
+	}
+}
+
+// fetchAll downloads every layer in layers into outputDir, blocking until
+// all of them have finished, and returns an error if any of them failed.
+func (bf *blobFetcher) fetchAll(u *URL, layers []*schema.ImageManifestDigest, outputDir string) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(layers))
+
+	for _, layer := range layers {
+		layer := layer
+		bf.sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-bf.sem }()
+			errs <- bf.fetchOne(u, layer.Digest, layer.MediaType, outputDir)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchOne downloads a single blob identified by layerDigest into outputDir,
+// unless a verified copy is already there. mediaType is the layer's own
+// declared media type, sent as the request's Accept header so arbitrary
+// OCI artifact layers (Helm charts, WASM modules, SBOMs, ...) are fetched
+// just as well as image filesystem layers.
+func (bf *blobFetcher) fetchOne(u *URL, layerDigest string, mediaType string, outputDir string) error {
+	finalPath := blobFile(outputDir, layerDigest)
+	if blobCached(finalPath, layerDigest) {
+		bf.of.debugMsg("blob %s already present, skipping download", layerDigest)
+		return nil
+	}
+
+	tempPath := finalPath + ".tmp"
+
+	verifier, err := digest.NewVerifier(layerDigest)
+	if err != nil {
+		return err
+	}
+
+	offset, err := hashExisting(tempPath, verifier)
+	if err != nil {
+		return err
+	}
+
+	if err := bf.downloadWithRetry(u, layerDigest, mediaType, tempPath, offset, verifier); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if !verifier.Verify() {
+		os.Remove(tempPath)
+		return fmt.Errorf("downloaded layer %s failed digest verification", layerDigest)
+	}
+
+	return os.Rename(tempPath, finalPath)
+}
+
+// downloadWithRetry drives the attempt loop for a single blob, retrying
+// retryable errors with exponential backoff and jitter.
+func (bf *blobFetcher) downloadWithRetry(u *URL, layerDigest, mediaType, tempPath string, offset int64, verifier *digest.Verifier) error {
+	var lastErr error
+	for attempt := 1; attempt <= maxFetchAttempts; attempt++ {
+		if attempt > 1 {
+			delay := backoff(attempt - 1)
+			bf.of.debugMsg("retrying download of %s in %s (attempt %d/%d): %v", layerDigest, delay, attempt, maxFetchAttempts, lastErr)
+			time.Sleep(delay)
+
+			// a failed first attempt may not have created tempPath yet
+			written, err := fileSize(tempPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			offset = written
+		}
+
+		retryable, err := bf.downloadAttempt(u, layerDigest, mediaType, tempPath, offset, verifier)
+		if err == nil {
+			return nil
+		}
+		if !retryable {
+			return err
+		}
+		lastErr = err
+	}
+	return fmt.Errorf("giving up on %s after %d attempts: %v", layerDigest, maxFetchAttempts, lastErr)
+}
+
+// downloadAttempt makes a single GET request for layerDigest, resuming from
+// offset via a Range header, and streams the response into tempPath,
+// feeding everything written through verifier. It reports whether a failed
+// attempt is worth retrying.
+func (bf *blobFetcher) downloadAttempt(u *URL, layerDigest, mediaType, tempPath string, offset int64, verifier *digest.Verifier) (retryable bool, err error) {
+	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "blobs", layerDigest)
+
+	req, err := http.NewRequest("GET", stringURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := bf.of.setBasicAuth(req); err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	res, err := bf.of.makeRequest(req, u.Name, mediaType)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		// resuming as requested
+	case http.StatusOK:
+		// the registry ignored our Range request and is sending the whole
+		// blob again, so discard whatever we'd already written and hashed
+		if offset > 0 {
+			if err := os.Truncate(tempPath, 0); err != nil {
+				return false, err
+			}
+			verifier.Reset()
+			offset = 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// our on-disk copy is already as large as the blob; truncate and
+		// restart so the next attempt gets a clean full download
+		if err := os.Truncate(tempPath, 0); err != nil {
+			return false, err
+		}
+		verifier.Reset()
+		return true, fmt.Errorf("range not satisfiable fetching %s, restarting", layerDigest)
+	default:
+		return res.StatusCode >= 500, fmt.Errorf("unexpected http code: %d, URL: %s", res.StatusCode, req.URL)
+	}
+
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	if _, err := io.Copy(io.MultiWriter(f, verifier), res.Body); err != nil {
+		return true, err
+	}
+
+	return false, nil
+}
+
+// blobCached reports whether path already holds content verified against
+// expectedDigest, so fetchOne can skip re-downloading it.
+func blobCached(path string, expectedDigest string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	verifier, err := digest.NewVerifier(expectedDigest)
+	if err != nil {
+		return false
+	}
+	if _, err := io.Copy(verifier, f); err != nil {
+		return false
+	}
+	return verifier.Verify()
+}
+
+// hashExisting feeds any data already present at path into verifier,
+// returning how many bytes it fed it. It returns 0 if path doesn't exist
+// yet, so a from-scratch download and a resumed one can share one code
+// path.
+func hashExisting(path string, verifier *digest.Verifier) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return io.Copy(verifier, f)
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// backoff returns how long to wait before retry attempt n (1-indexed),
+// using exponential backoff with jitter so many concurrent blob downloads
+// failing at once don't all hammer the registry again in lockstep.
+func backoff(n int) time.Duration {
+	base := retryBaseDelay * time.Duration(1<<uint(n-1))
+	return base + time.Duration(rand.Int63n(int64(base)))
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package digest provides verification of content against OCI/Docker
+// "<algorithm>:<hex>" digest strings.
+package digest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Verifier is an io.Writer that accumulates a hash of everything written to
+// it, so it can be verified against an expected digest once all the data
+// has been seen.
+type Verifier struct {
+	algorithm string
+	expected  string
+	hash      hash.Hash
+}
+
+// NewVerifier returns a Verifier that checks data written to it against
+// expectedDigest, a digest string in the form "<algorithm>:<hex>" (e.g.
+// "sha256:abcd..."). Only the sha256 and sha512 algorithms are supported.
+func NewVerifier(expectedDigest string) (*Verifier, error) {
+	algorithm, _, err := split(expectedDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm: %s", algorithm)
+	}
+
+	return &Verifier{algorithm: algorithm, expected: expectedDigest, hash: h}, nil
+}
+
+// Write implements io.Writer, feeding p into the underlying hash.
+func (v *Verifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+// Verify reports whether the data written so far hashes to the expected
+// digest.
+func (v *Verifier) Verify() bool {
+	computed := v.algorithm + ":" + hex.EncodeToString(v.hash.Sum(nil))
+	return computed == v.expected
+}
+
+// Reset discards any data written so far, so the Verifier can be reused to
+// check a fresh copy of the content (e.g. after a resumed download turned
+// out to need a restart from scratch).
+func (v *Verifier) Reset() {
+	v.hash.Reset()
+}
+
+func split(digest string) (algorithm string, hexPart string, err error) {
+	idx := strings.Index(digest, ":")
+	if idx <= 0 || idx == len(digest)-1 {
+		return "", "", fmt.Errorf("invalid digest %q: expected \"<algorithm>:<hex>\"", digest)
+	}
+	return digest[:idx], digest[idx+1:], nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package digest
+
+import "testing"
+
+func TestNewVerifierInvalidDigest(t *testing.T) {
+	tests := []string{
+		"",
+		"sha256",
+		"sha256:",
+		":abcd",
+		"sha1:abcd",
+	}
+
+	for _, digest := range tests {
+		t.Run(digest, func(t *testing.T) {
+			if _, err := NewVerifier(digest); err == nil {
+				t.Errorf("NewVerifier(%q) returned no error, want one", digest)
+			}
+		})
+	}
+}
+
+func TestVerifierVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		digest string
+		data   string
+		want   bool
+	}{
+		{
+			name:   "sha256 match",
+			digest: "sha256:ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+			data:   "a",
+			want:   true,
+		},
+		{
+			name:   "sha256 mismatch",
+			digest: "sha256:ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+			data:   "b",
+			want:   false,
+		},
+		{
+			name:   "sha512 match",
+			digest: "sha512:1f40fc92da241694750979ee6cf582f2d5d7d28e18335de05abc54d0560e0f5302860c652bf08d560252aa5e74210546f369fbbbce8c12cfc7957b2652fe9a75",
+			data:   "a",
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewVerifier(tt.digest)
+			if err != nil {
+				t.Fatalf("NewVerifier(%q) returned unexpected error: %v", tt.digest, err)
+			}
+			if _, err := v.Write([]byte(tt.data)); err != nil {
+				t.Fatalf("Write returned unexpected error: %v", err)
+			}
+			if got := v.Verify(); got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifierReset(t *testing.T) {
+	const digest = "sha256:ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"
+
+	v, err := NewVerifier(digest)
+	if err != nil {
+		t.Fatalf("NewVerifier(%q) returned unexpected error: %v", digest, err)
+	}
+
+	if _, err := v.Write([]byte("wrong data")); err != nil {
+		t.Fatalf("Write returned unexpected error: %v", err)
+	}
+	if v.Verify() {
+		t.Fatalf("Verify() = true before Reset, want false")
+	}
+
+	v.Reset()
+	if _, err := v.Write([]byte("a")); err != nil {
+		t.Fatalf("Write returned unexpected error: %v", err)
+	}
+	if !v.Verify() {
+		t.Errorf("Verify() = false after Reset and writing the correct data, want true")
+	}
+}
@@ -18,42 +18,74 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"time"
+	"sync"
 
+	"github.com/containers/oci-fetch/lib/auth"
+	"github.com/containers/oci-fetch/lib/digest"
 	"github.com/containers/oci-fetch/lib/schema"
-	"github.com/coreos/pkg/progressutil"
 )
 
 // OCIFetcher is a struct that can be used to fetch OCI images from a remote
 // registry.
 type OCIFetcher struct {
-	username                    string
-	password                    string
-	hostsV2AuthTokens           map[string]map[string]string
+	// keychain resolves the credentials to use for a given registry host.
+	keychain          auth.Keychain
+	hostsV2AuthTokens map[string]map[string]string
+	// authCacheMu guards authCache, since blobFetcher's concurrent
+	// downloads call authConfig from several goroutines at once.
+	authCacheMu sync.Mutex
+	// authCache memoizes authConfig's result per host, so that resolving
+	// credentials - which may shell out to a docker-credential-* helper
+	// or read config.json off disk - happens once per host rather than
+	// once per HTTP request.
+	authCache                   map[string]*auth.Config
 	insecureAllowHTTP           bool
 	insecureSkipTLSVerification bool
 	debug                       bool
+	// platform selects which child manifest to fetch when a tag resolves
+	// to an OCI image index or Docker manifest list. The zero value means
+	// "use the host's platform".
+	platform Platform
+	// preserveIndex, when true, makes Fetch keep the ref in refs/<tag>
+	// pointing at the fetched image index instead of the selected child
+	// manifest.
+	preserveIndex bool
+	// maxConcurrentDownloads bounds how many blobs are downloaded at once.
+	// Zero means defaultMaxConcurrentDownloads.
+	maxConcurrentDownloads int
 }
 
 // NewOCIFetcher returns a new OCIFetcher, configured with the provided
-// arguments.
-func NewOCIFetcher(username, password string, insecureAllowHTTP, insecureSkipTLSVerification, debug bool) *OCIFetcher {
+// arguments. keychain resolves the credentials to use per-registry-host; a
+// nil keychain selects auth.NewDefaultKeychain(), which reads
+// ~/.docker/config.json and its credential helpers, falling back to
+// anonymous access. maxConcurrentDownloads bounds how many blobs are
+// downloaded in parallel; a value <= 0 selects
+// defaultMaxConcurrentDownloads.
+func NewOCIFetcher(keychain auth.Keychain, insecureAllowHTTP, insecureSkipTLSVerification, debug bool, platform Platform, preserveIndex bool, maxConcurrentDownloads int) *OCIFetcher {
+	if keychain == nil {
+		keychain = auth.NewDefaultKeychain()
+	}
+	if maxConcurrentDownloads <= 0 {
+		maxConcurrentDownloads = defaultMaxConcurrentDownloads
+	}
 	return &OCIFetcher{
-		username:                    username,
-		password:                    password,
+		keychain:                    keychain,
 		hostsV2AuthTokens:           make(map[string]map[string]string),
+		authCache:                   make(map[string]*auth.Config),
 		insecureAllowHTTP:           insecureAllowHTTP,
 		insecureSkipTLSVerification: insecureSkipTLSVerification,
-		debug: debug,
+		debug:                       debug,
+		platform:                    platform,
+		preserveIndex:               preserveIndex,
+		maxConcurrentDownloads:      maxConcurrentDownloads,
 	}
 }
 
@@ -77,6 +109,28 @@ func refsDir(outputDir string) string {
 	return filepath.Join(outputDir, "refs")
 }
 
+// verifyDigest hashes blob and compares it against expectedDigest, a digest
+// string in the form "<algorithm>:<hex>".
+func verifyDigest(expectedDigest string, blob []byte) error {
+	verifier, err := digest.NewVerifier(expectedDigest)
+	if err != nil {
+		return err
+	}
+	if _, err := verifier.Write(blob); err != nil {
+		return err
+	}
+	if !verifier.Verify() {
+		return fmt.Errorf("digest verification failed: expected %s", expectedDigest)
+	}
+	return nil
+}
+
+// isDigestReference reports whether reference is a content digest (e.g.
+// "sha256:abcd...") rather than a tag; tags can't contain ":".
+func isDigestReference(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
 // Fetch will download the image represented by u into outputDir.
 func (of *OCIFetcher) Fetch(u *URL, outputDir string) error {
 	// create the blobs and refs directories
@@ -98,46 +152,18 @@ func (of *OCIFetcher) Fetch(u *URL, outputDir string) error {
 	manifest := manifestData.manifest
 	of.debugMsg("manifest successfully retrieved")
 
-	configData, err := of.fetchConfig(u, manifest.Config.Digest, manifest.Config.Size, outputDir)
+	configData, err := of.fetchConfig(u, manifest.Config.Digest, manifest.Config.Size)
 	if err != nil {
 		return err
 	}
 	of.debugMsg("config successfully retrieved")
 
-	// download all of the layers into the blobs directory, displaying progress
-	// bars for the user
-	cpp := progressutil.NewCopyProgressPrinter()
+	// download all of the layers into the blobs directory, skipping any
+	// that are already cached on disk, with concurrency capped by
+	// of.maxConcurrentDownloads
 	layers := removeDuplicateLayers(manifest.Layers)
-
-	var doneChans []chan error
-	var closerChans []chan []io.Closer
-	for _, layer := range layers {
-		layer := layer
-		doneChan := make(chan error, 1)
-		doneChans = append(doneChans, doneChan)
-		closerChan := make(chan []io.Closer, 1)
-		closerChans = append(closerChans, closerChan)
-		go func() {
-			closers, err := of.fetchLayer(u, layer.Digest, layer.Size, outputDir, cpp)
-			closerChan <- closers
-			doneChan <- err
-		}()
-	}
-	defer func() {
-		for _, closerChan := range closerChans {
-			closers := <-closerChan
-			for _, closer := range closers {
-				closer.Close()
-			}
-		}
-	}()
-	for _, doneChan := range doneChans {
-		if err := <-doneChan; err != nil {
-			return err
-		}
-	}
-	err = cpp.PrintAndWait(os.Stderr, time.Second, nil)
-	if err != nil {
+	bf := newBlobFetcher(of)
+	if err := bf.fetchAll(u, layers, outputDir); err != nil {
 		return err
 	}
 	of.debugMsg("layers successfully retrieved")
@@ -157,13 +183,28 @@ func (of *OCIFetcher) Fetch(u *URL, outputDir string) error {
 	if err := ioutil.WriteFile(blobFile(outputDir, manifest.Config.Digest), configData.blob, 0644); err != nil {
 		return err
 	}
-	// Write the descriptor into the refs folder
+
+	// Write the descriptor into the refs folder, pointing at the image
+	// index instead of the selected child manifest when the caller asked
+	// to preserve it.
 	descriptor := schema.Descriptor{
 		MediaType: schema.MediaTypeManifest,
 		Digest:    manifestData.digest,
 		Size:      manifestData.size,
 	}
-	err = writeJSONToFile(path.Join(refsDir(outputDir), u.Version), descriptor)
+	if manifestData.index != nil {
+		if err := ioutil.WriteFile(blobFile(outputDir, manifestData.index.digest), manifestData.index.blob, 0644); err != nil {
+			return err
+		}
+		if of.preserveIndex {
+			descriptor = schema.Descriptor{
+				MediaType: manifestData.index.mediaType,
+				Digest:    manifestData.index.digest,
+				Size:      manifestData.index.size,
+			}
+		}
+	}
+	err = writeJSONToFile(path.Join(refsDir(outputDir), u.Reference()), descriptor)
 	if err != nil {
 		return err
 	}
@@ -195,24 +236,65 @@ func writeJSONToFile(path string, data interface{}) error {
 	return ioutil.WriteFile(path, blob, 0644)
 }
 
+// indexManifestAccept is the list of media types accepted when resolving an
+// image tag, so that a tag pointing at a multi-arch OCI image index or
+// Docker manifest list is recognized rather than rejected.
+var indexManifestAccept = strings.Join([]string{
+	schema.MediaTypeManifest,
+	schema.MediaTypeImageIndex,
+	schema.MediaTypeDockerManifestList,
+}, ",")
+
+// artifactManifestAccept is the list of media types accepted when
+// resolving a generic OCI artifact reference: the dedicated OCI artifact
+// manifest media type, plus the plain OCI manifest media type that many
+// artifact publishers (e.g. Helm's OCI support) still use, distinguishing
+// themselves only by their manifest's config media type.
+var artifactManifestAccept = strings.Join([]string{
+	schema.MediaTypeArtifactManifest,
+	schema.MediaTypeManifest,
+}, ",")
+
+// manifestIndexData holds the raw image index or manifest list a tag
+// resolved to, before the child manifest matching the requested platform
+// was selected.
+type manifestIndexData struct {
+	blob      []byte
+	digest    string
+	size      int
+	mediaType string
+}
+
 type manifestData struct {
 	manifest *schema.ImageManifest
 	blob     []byte
 	digest   string
 	size     int
+	// mediaType is the media type this manifest was served as, e.g.
+	// schema.MediaTypeManifest or schema.MediaTypeArtifactManifest.
+	mediaType string
+	// index is set when the requested reference resolved to an image
+	// index or manifest list, and this manifest was selected from it.
+	index *manifestIndexData
 }
 
 func (of *OCIFetcher) fetchManifest(u *URL, outputDir string) (*manifestData, error) {
-	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "manifests", u.Version)
+	return of.fetchManifestByReference(u, u.Reference(), outputDir, indexManifestAccept)
+}
+
+func (of *OCIFetcher) fetchManifestByReference(u *URL, reference string, outputDir string, accept string) (*manifestData, error) {
+	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "manifests", reference)
 
 	req, err := http.NewRequest("GET", stringURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	of.setBasicAuth(req)
+	if err := of.setBasicAuth(req); err != nil {
+		return nil, err
+	}
 
-	res, err := of.makeRequest(req, u.Name, schema.MediaTypeManifest)
+	res, err := of.makeRequest(req, u.Name, accept)
 	if err != nil {
 		return nil, err
 	}
@@ -227,112 +309,140 @@ func (of *OCIFetcher) fetchManifest(u *URL, outputDir string) (*manifestData, er
 		return nil, fmt.Errorf("response headers doesn't contain manifest digest")
 	}
 
-	manblob, err := ioutil.ReadAll(res.Body)
+	// a tag can never contain ":" (unlike a digest), so this also covers
+	// the index recursion below, which always resolves a child by digest
+	if isDigestReference(reference) && digest != reference {
+		return nil, fmt.Errorf("registry returned manifest digest %s, expected %s", digest, reference)
+	}
+
+	blob, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := verifyDigest(digest, blob); err != nil {
+		return nil, err
+	}
+
+	mediaType := res.Header.Get("Content-Type")
+	if isImageIndexMediaType(mediaType) {
+		index := &schema.ImageIndex{}
+		if err := json.Unmarshal(blob, index); err != nil {
+			return nil, err
+		}
+
+		platform := of.platform
+		if platform.isZero() {
+			platform = hostPlatform()
+		}
+
+		selected, err := selectManifestForPlatform(index, platform)
+		if err != nil {
+			return nil, err
+		}
+
+		childData, err := of.fetchManifestByReference(u, selected.Digest, outputDir, accept)
+		if err != nil {
+			return nil, err
+		}
+		childData.index = &manifestIndexData{
+			blob:      blob,
+			digest:    digest,
+			size:      len(blob),
+			mediaType: mediaType,
+		}
+		return childData, nil
+	}
+
+	// manifest.Config.MediaType and each of manifest.Layers' MediaType are
+	// left opaque here: FetchArtifact relies on this to pull non-image
+	// artifacts whose config and layers aren't image configs or rootfs
+	// layers at all.
 	manifest := &schema.ImageManifest{}
 
-	err = json.Unmarshal(manblob, manifest)
+	err = json.Unmarshal(blob, manifest)
 	if err != nil {
 		return nil, err
 	}
 
 	manifestData := manifestData{
-		manifest: manifest,
-		blob:     manblob,
-		digest:   digest,
-		size:     len(manblob),
+		manifest:  manifest,
+		blob:      blob,
+		digest:    digest,
+		size:      len(blob),
+		mediaType: mediaType,
 	}
 	return &manifestData, manifest.Validate()
 }
 
+func isImageIndexMediaType(mediaType string) bool {
+	switch mediaType {
+	case schema.MediaTypeImageIndex, schema.MediaTypeDockerManifestList:
+		return true
+	default:
+		return false
+	}
+}
+
 type configData struct {
 	config *schema.ImageConfig
 	blob   []byte
 }
 
-func (of *OCIFetcher) fetchConfig(u *URL, configDigest string, expectedSize int, outputDir string) (*configData, error) {
-	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "blobs", configDigest)
-
-	req, err := http.NewRequest("GET", stringURL, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	of.setBasicAuth(req)
-
-	res, err := of.makeRequest(req, u.Name, schema.MediaTypeConfig)
+func (of *OCIFetcher) fetchConfig(u *URL, configDigest string, expectedSize int) (*configData, error) {
+	blob, err := of.fetchBlob(u, configDigest, expectedSize, schema.MediaTypeConfig)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected http code: %d, URL: %s", res.StatusCode, req.URL)
-	}
-
-	confblob, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(confblob) != expectedSize {
-		return nil, fmt.Errorf("retrieved image config didn't match expected size, expected=%d actual=%d", expectedSize, len(confblob))
-	}
 
 	config := &schema.ImageConfig{}
-
-	err = json.Unmarshal(confblob, config)
-	if err != nil {
+	if err := json.Unmarshal(blob, config); err != nil {
 		return nil, err
 	}
 
-	return &configData{config: config, blob: confblob}, nil
+	return &configData{config: config, blob: blob}, nil
 }
 
-func (of *OCIFetcher) fetchLayer(u *URL, layerDigest string, expectedSize int, outputDir string, cpp *progressutil.CopyProgressPrinter) ([]io.Closer, error) {
-	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "blobs", layerDigest)
-
-	var closers []io.Closer
+// fetchBlob downloads the blob identified by blobDigest in a single GET,
+// verifying it against blobDigest and expectedSize. acceptMediaType is
+// sent as the Accept header; for a config or artifact blob it's whatever
+// the manifest declared, treated as opaque.
+func (of *OCIFetcher) fetchBlob(u *URL, blobDigest string, expectedSize int, acceptMediaType string) ([]byte, error) {
+	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "blobs", blobDigest)
 
 	req, err := http.NewRequest("GET", stringURL, nil)
 	if err != nil {
-		return closers, err
+		return nil, err
 	}
 
-	of.setBasicAuth(req)
+	if err := of.setBasicAuth(req); err != nil {
+		return nil, err
+	}
 
-	res, err := of.makeRequest(req, u.Name, schema.MediaTypeRootFS)
+	res, err := of.makeRequest(req, u.Name, acceptMediaType)
 	if err != nil {
-		return closers, err
+		return nil, err
 	}
-	closers = append(closers, res.Body)
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return closers, fmt.Errorf("unexpected http code: %d, URL: %s", res.StatusCode, req.URL)
+		return nil, fmt.Errorf("unexpected http code: %d, URL: %s", res.StatusCode, req.URL)
 	}
 
-	f, err := os.Create(blobFile(outputDir, layerDigest))
+	blob, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return closers, err
+		return nil, err
 	}
-	closers = append(closers, f)
 
-	name := strings.TrimPrefix(layerDigest, "sha256:")
-	if len(name) > 12 {
-		name = name[:12]
+	if err := verifyDigest(blobDigest, blob); err != nil {
+		return nil, err
 	}
 
-	size, err := strconv.ParseInt(res.Header.Get("content-length"), 10, 64)
-	if err != nil {
-		size = 0
+	if len(blob) != expectedSize {
+		return nil, fmt.Errorf("retrieved blob didn't match expected size, expected=%d actual=%d", expectedSize, len(blob))
 	}
 
-	cpp.AddCopy(res.Body, name, size, f)
-
-	return closers, nil
+	return blob, nil
 }
 
 func (of *OCIFetcher) makeRequest(req *http.Request, repo string, mediaType string) (*http.Response, error) {
@@ -375,7 +485,9 @@ func (of *OCIFetcher) makeRequest(req *http.Request, repo string, mediaType stri
 
 	of.debugMsg("need to get auth token: %s", hdr)
 
-	of.acquireAuthToken(client, hdr, repo, req.URL.Host)
+	if err := of.acquireAuthToken(client, hdr, repo, req.URL.Host); err != nil {
+		return nil, err
+	}
 
 	return of.makeRequest(req, repo, mediaType)
 }
@@ -0,0 +1,92 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/containers/oci-fetch/lib/schema"
+)
+
+// Platform identifies a single os/architecture/variant combination, used to
+// select a child manifest out of an OCI image index or Docker manifest
+// list.
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+func (p Platform) isZero() bool {
+	return p.OS == "" && p.Architecture == ""
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+}
+
+// ParsePlatform parses a platform string in the form "os/arch[/variant]"
+// into a Platform, for callers that expose a "--platform" flag of their
+// own and want to pass the result to NewOCIFetcher; this package has no
+// CLI of its own.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// hostPlatform returns the Platform of the machine oci-fetch is running on.
+func hostPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// selectManifestForPlatform picks the child manifest of index matching
+// platform, returning an error listing the available platforms when none
+// match.
+func selectManifestForPlatform(index *schema.ImageIndex, platform Platform) (*schema.ManifestDescriptor, error) {
+	var available []string
+	for _, m := range index.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		available = append(available, platformString(m.Platform))
+		if m.Platform.OS != platform.OS || m.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant != "" && m.Platform.Variant != platform.Variant {
+			continue
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("no manifest found for platform %s, available platforms: %s", platform, strings.Join(available, ", "))
+}
+
+func platformString(p *schema.Platform) string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+}
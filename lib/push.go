@@ -0,0 +1,378 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/containers/oci-fetch/lib/schema"
+)
+
+// blobUploadChunkSize is how much of a blob is sent per PATCH request
+// during a chunked upload.
+const blobUploadChunkSize = 4 << 20 // 4MiB
+
+// Push uploads the OCI layout rooted at layoutDir to the reference
+// described by u, the symmetric counterpart of Fetch: it reads the ref
+// written by a prior Fetch (or produced by another OCI-layout-producing
+// tool), uploads every blob the manifest it points to references (or, for
+// an image index, every child manifest and their blobs), then the
+// manifest itself.
+//
+// mountFrom, if non-empty, is the name of a repository on the same
+// registry that blobs may already exist in; Push asks the registry to
+// cross-repository mount each blob from it before falling back to a full
+// upload. Pass "" to always upload blobs directly.
+func (of *OCIFetcher) Push(layoutDir string, u *URL, mountFrom string) error {
+	descriptor, err := readRefDescriptor(layoutDir, u.Reference())
+	if err != nil {
+		return err
+	}
+
+	blob, err := ioutil.ReadFile(blobFile(layoutDir, descriptor.Digest))
+	if err != nil {
+		return err
+	}
+
+	if isImageIndexMediaType(descriptor.MediaType) {
+		index := &schema.ImageIndex{}
+		if err := json.Unmarshal(blob, index); err != nil {
+			return err
+		}
+		for _, m := range index.Manifests {
+			if err := of.pushManifestAndBlobs(u, layoutDir, m.Digest, m.MediaType, mountFrom); err != nil {
+				return err
+			}
+		}
+	} else if err := of.pushManifestAndBlobs(u, layoutDir, descriptor.Digest, descriptor.MediaType, mountFrom); err != nil {
+		return err
+	}
+
+	of.debugMsg("pushing %s as %s", descriptor.Digest, u.Reference())
+	return of.putManifest(u, u.Reference(), descriptor.MediaType, blob)
+}
+
+func readRefDescriptor(layoutDir, reference string) (*schema.Descriptor, error) {
+	blob, err := ioutil.ReadFile(path.Join(refsDir(layoutDir), reference))
+	if err != nil {
+		return nil, err
+	}
+	descriptor := &schema.Descriptor{}
+	if err := json.Unmarshal(blob, descriptor); err != nil {
+		return nil, err
+	}
+	return descriptor, nil
+}
+
+// pushManifestAndBlobs uploads the config and layer blobs a single image
+// manifest references, then the manifest itself, addressed by its own
+// digest so that an image index can reference it. mediaType is the
+// manifest's own recorded media type (schema.MediaTypeManifest,
+// schema.MediaTypeArtifactManifest, ...), PUT as its Content-Type rather
+// than assumed.
+func (of *OCIFetcher) pushManifestAndBlobs(u *URL, layoutDir string, manifestDigest string, mediaType string, mountFrom string) error {
+	manifestBlob, err := ioutil.ReadFile(blobFile(layoutDir, manifestDigest))
+	if err != nil {
+		return err
+	}
+	manifest := &schema.ImageManifest{}
+	if err := json.Unmarshal(manifestBlob, manifest); err != nil {
+		return err
+	}
+
+	if err := of.pushBlob(u, layoutDir, manifest.Config.Digest, manifest.Config.MediaType, mountFrom); err != nil {
+		return err
+	}
+	for _, layer := range removeDuplicateLayers(manifest.Layers) {
+		if err := of.pushBlob(u, layoutDir, layer.Digest, layer.MediaType, mountFrom); err != nil {
+			return err
+		}
+	}
+
+	return of.putManifest(u, manifestDigest, mediaType, manifestBlob)
+}
+
+// pushBlob uploads the blob identified by digest from layoutDir into u's
+// repository, unless the registry already has it.
+func (of *OCIFetcher) pushBlob(u *URL, layoutDir string, digest string, mediaType string, mountFrom string) error {
+	exists, err := of.blobExistsRemote(u, digest, mediaType)
+	if err != nil {
+		return err
+	}
+	if exists {
+		of.debugMsg("blob %s already present on registry, skipping upload", digest)
+		return nil
+	}
+
+	if mountFrom != "" {
+		mounted, err := of.mountBlob(u, digest, mountFrom)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			of.debugMsg("blob %s mounted from %s, skipping upload", digest, mountFrom)
+			return nil
+		}
+	}
+
+	f, err := os.Open(blobFile(layoutDir, digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	location, err := of.startBlobUpload(u)
+	if err != nil {
+		return err
+	}
+
+	location, err = of.uploadBlobChunks(u, location, f, info.Size())
+	if err != nil {
+		return err
+	}
+
+	return of.finalizeBlobUpload(u, location, digest)
+}
+
+// blobExistsRemote reports whether u's repository already has digest,
+// using the registry's existence-check HEAD request. mediaType is the
+// blob's own recorded media type, passed through like blobFetcher does,
+// rather than assuming every blob is a filesystem layer.
+func (of *OCIFetcher) blobExistsRemote(u *URL, digest string, mediaType string) (bool, error) {
+	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "blobs", digest)
+
+	req, err := http.NewRequest("HEAD", stringURL, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := of.setBasicAuth(req); err != nil {
+		return false, err
+	}
+
+	res, err := of.makeRequest(req, u.Name, mediaType)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode == http.StatusOK, nil
+}
+
+// mountBlob asks the registry to cross-repository mount digest from
+// fromRepo into u's repository, so it doesn't have to be re-uploaded. It
+// reports whether the mount succeeded; a false with a nil error means the
+// registry declined it and the caller should fall back to a full upload.
+func (of *OCIFetcher) mountBlob(u *URL, digest string, fromRepo string) (bool, error) {
+	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "blobs", "uploads") + "/"
+
+	req, err := http.NewRequest("POST", stringURL, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := of.setBasicAuth(req); err != nil {
+		return false, err
+	}
+
+	q := req.URL.Query()
+	q.Set("mount", digest)
+	q.Set("from", fromRepo)
+	req.URL.RawQuery = q.Encode()
+
+	res, err := of.makeRequest(req, u.Name, "")
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		// the registry doesn't have it under fromRepo either and started a
+		// normal upload session instead; abandon that session and let the
+		// caller upload it directly.
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected http code mounting blob: %d, URL: %s", res.StatusCode, req.URL)
+	}
+}
+
+// startBlobUpload begins a chunked blob upload session in u's repository,
+// returning the Location to PATCH the first chunk to.
+func (of *OCIFetcher) startBlobUpload(u *URL) (string, error) {
+	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "blobs", "uploads") + "/"
+
+	req, err := http.NewRequest("POST", stringURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := of.setBasicAuth(req); err != nil {
+		return "", err
+	}
+
+	res, err := of.makeRequest(req, u.Name, "")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("unexpected http code starting blob upload: %d, URL: %s", res.StatusCode, req.URL)
+	}
+
+	location := res.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("registry didn't return a Location header starting the blob upload")
+	}
+	return location, nil
+}
+
+// uploadBlobChunks PATCHes the content of r, which must be exactly size
+// bytes long, to location in blobUploadChunkSize pieces, following the
+// Location each response returns to find where to PATCH the next one. It
+// returns the Location to finalize the upload at.
+func (of *OCIFetcher) uploadBlobChunks(u *URL, location string, r io.Reader, size int64) (string, error) {
+	buf := make([]byte, blobUploadChunkSize)
+	var offset int64
+
+	for offset < size {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return "", err
+		}
+
+		stringURL, err := resolveLocation(u.Host, location)
+		if err != nil {
+			return "", err
+		}
+
+		req, err := http.NewRequest("PATCH", stringURL, bytes.NewReader(buf[:n]))
+		if err != nil {
+			return "", err
+		}
+		if err := of.setBasicAuth(req); err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(n)-1))
+		req.ContentLength = int64(n)
+
+		res, err := of.makeRequest(req, u.Name, "")
+		if err != nil {
+			return "", err
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusAccepted {
+			return "", fmt.Errorf("unexpected http code uploading blob chunk: %d, URL: %s", res.StatusCode, req.URL)
+		}
+
+		location = res.Header.Get("Location")
+		if location == "" {
+			return "", fmt.Errorf("registry didn't return a Location header for the next blob chunk")
+		}
+
+		offset += int64(n)
+	}
+
+	return location, nil
+}
+
+// finalizeBlobUpload closes out the upload session at location, telling
+// the registry the fully uploaded blob's digest so it can validate it.
+func (of *OCIFetcher) finalizeBlobUpload(u *URL, location string, digest string) error {
+	stringURL, err := resolveLocation(u.Host, location)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", stringURL, nil)
+	if err != nil {
+		return err
+	}
+	if err := of.setBasicAuth(req); err != nil {
+		return err
+	}
+
+	q := req.URL.Query()
+	q.Set("digest", digest)
+	req.URL.RawQuery = q.Encode()
+
+	res, err := of.makeRequest(req, u.Name, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected http code finalizing blob upload: %d, URL: %s", res.StatusCode, req.URL)
+	}
+	return nil
+}
+
+// putManifest PUTs blob, whose media type is mediaType, to
+// /v2/<name>/manifests/<reference>.
+func (of *OCIFetcher) putManifest(u *URL, reference string, mediaType string, blob []byte) error {
+	stringURL := "https://" + path.Join(u.Host, "v2", u.Name, "manifests", reference)
+
+	req, err := http.NewRequest("PUT", stringURL, bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	if err := of.setBasicAuth(req); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	req.ContentLength = int64(len(blob))
+
+	res, err := of.makeRequest(req, u.Name, mediaType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected http code pushing manifest: %d, URL: %s", res.StatusCode, req.URL)
+	}
+	return nil
+}
+
+// resolveLocation resolves a blob-upload Location header, which registries
+// may return as either an absolute URL or a path relative to host, into an
+// absolute URL.
+func resolveLocation(host string, location string) (string, error) {
+	base, err := url.Parse("https://" + host)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
@@ -23,35 +23,117 @@ var (
 	ErrInvalidImageName = fmt.Errorf("failed to parse image name")
 )
 
-const defaultVersion = "latest"
+const (
+	defaultVersion = "latest"
+	// defaultHost and defaultNamespace are filled in when a reference
+	// omits its registry, mirroring what docker and containerd do for a
+	// reference like "alpine" or "library/alpine".
+	defaultHost      = "registry-1.docker.io"
+	defaultNamespace = "library"
+)
 
+// URL is a parsed image or artifact reference, following the distribution
+// reference grammar: an optional "host[:port]/" prefix, a possibly
+// multi-component name, and an optional ":tag" and/or "@digest".
 type URL struct {
 	Host    string
 	Name    string
 	Version string
+	// Digest, when non-empty, pins the reference to a specific content
+	// digest (e.g. "sha256:abcd...") instead of, or in addition to, a
+	// mutable tag, as in "alpine:3.18@sha256:abcd...".
+	Digest string
 }
 
-func NewURL(url string) (*URL, error) {
-	tokens := strings.Split(url, "/")
-	if len(tokens) <= 1 {
+// NewURL parses ref, e.g. "alpine", "library/alpine:3.18",
+// "localhost:5000/foo", "ghcr.io/org/repo:tag", or
+// "ghcr.io/org/repo@sha256:abcd...", into a URL.
+func NewURL(ref string) (*URL, error) {
+	if ref == "" {
+		return nil, ErrInvalidImageName
+	}
+
+	nameAndTag, digest := splitDigest(ref)
+
+	host, nameAndTag := splitHost(nameAndTag)
+
+	name, version := splitTag(nameAndTag)
+	if name == "" {
 		return nil, ErrInvalidImageName
 	}
-	host := tokens[0]
-	name := strings.Join(tokens[1:], "/")
-	version := defaultVersion
-	if strings.Contains(tokens[len(tokens)-1], ":") {
-		lastToken := tokens[len(tokens)-1]
-		colonIndex := strings.Index(lastToken, ":")
-		version = lastToken[colonIndex+1:]
-		tokens[len(tokens)-1] = lastToken[:colonIndex]
+
+	if host == "" {
+		host = defaultHost
+		if !strings.Contains(name, "/") {
+			name = defaultNamespace + "/" + name
+		}
 	}
+
 	return &URL{
 		Host:    host,
 		Name:    name,
 		Version: version,
+		Digest:  digest,
 	}, nil
 }
 
+// splitDigest splits ref into the part before its last "@", and the
+// digest after it, if ref has one.
+func splitDigest(ref string) (string, string) {
+	idx := strings.LastIndex(ref, "@")
+	if idx < 0 {
+		return ref, ""
+	}
+	return ref[:idx], ref[idx+1:]
+}
+
+// splitHost splits ref's leading "host[:port]/" off of its name[:tag], if
+// its first path component looks like a host: it contains a "." or ":",
+// or is literally "localhost". Without one of those markers, a single
+// first component like "library" in "library/alpine" is part of the name,
+// not a host.
+func splitHost(ref string) (string, string) {
+	idx := strings.Index(ref, "/")
+	if idx < 0 {
+		return "", ref
+	}
+	first := ref[:idx]
+	if first == "localhost" || strings.ContainsAny(first, ".:") {
+		return first, ref[idx+1:]
+	}
+	return "", ref
+}
+
+// splitTag splits nameAndTag's trailing ":tag" off of its name, defaulting
+// to defaultVersion when there isn't one. splitHost has already removed
+// any host[:port] prefix, so the only colon left to find is in the last
+// path component.
+func splitTag(nameAndTag string) (string, string) {
+	lastSlash := strings.LastIndex(nameAndTag, "/")
+	lastComponent := nameAndTag[lastSlash+1:]
+
+	colonIdx := strings.Index(lastComponent, ":")
+	if colonIdx < 0 {
+		return nameAndTag, defaultVersion
+	}
+
+	name := nameAndTag[:lastSlash+1] + lastComponent[:colonIdx]
+	tag := lastComponent[colonIdx+1:]
+	return name, tag
+}
+
+// Reference returns the digest, if u pins one, or its tag otherwise —
+// whichever the registry should resolve the manifest by.
+func (u *URL) Reference() string {
+	if u.Digest != "" {
+		return u.Digest
+	}
+	return u.Version
+}
+
 func (u *URL) String() string {
+	if u.Digest != "" {
+		return fmt.Sprintf("%s/%s@%s", u.Host, u.Name, u.Digest)
+	}
 	return fmt.Sprintf("%s/%s:%s", u.Host, u.Name, u.Version)
 }
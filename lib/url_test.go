@@ -0,0 +1,133 @@
+// Copyright 2016 The Linux Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import "testing"
+
+func TestNewURL(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    URL
+		wantErr bool
+	}{
+		{
+			ref:  "alpine",
+			want: URL{Host: defaultHost, Name: "library/alpine", Version: defaultVersion},
+		},
+		{
+			ref:  "library/alpine",
+			want: URL{Host: defaultHost, Name: "library/alpine", Version: defaultVersion},
+		},
+		{
+			ref:  "alpine:3.18",
+			want: URL{Host: defaultHost, Name: "library/alpine", Version: "3.18"},
+		},
+		{
+			ref:  "myorg/private",
+			want: URL{Host: defaultHost, Name: "myorg/private", Version: defaultVersion},
+		},
+		{
+			ref:  "localhost:5000/foo",
+			want: URL{Host: "localhost:5000", Name: "foo", Version: defaultVersion},
+		},
+		{
+			ref:  "localhost:5000/foo:bar",
+			want: URL{Host: "localhost:5000", Name: "foo", Version: "bar"},
+		},
+		{
+			ref:  "localhost/foo",
+			want: URL{Host: "localhost", Name: "foo", Version: defaultVersion},
+		},
+		{
+			ref:  "ghcr.io/org/repo:tag",
+			want: URL{Host: "ghcr.io", Name: "org/repo", Version: "tag"},
+		},
+		{
+			ref:  "ghcr.io/org/repo",
+			want: URL{Host: "ghcr.io", Name: "org/repo", Version: defaultVersion},
+		},
+		{
+			ref: "ghcr.io/org/repo@sha256:d34db33fd34db33fd34db33fd34db33fd34db33fd34db33fd34db33fd34db33",
+			want: URL{
+				Host:    "ghcr.io",
+				Name:    "org/repo",
+				Version: defaultVersion,
+				Digest:  "sha256:d34db33fd34db33fd34db33fd34db33fd34db33fd34db33fd34db33fd34db33",
+			},
+		},
+		{
+			ref: "alpine:3.18@sha256:d34db33fd34db33fd34db33fd34db33fd34db33fd34db33fd34db33fd34db33",
+			want: URL{
+				Host:    defaultHost,
+				Name:    "library/alpine",
+				Version: "3.18",
+				Digest:  "sha256:d34db33fd34db33fd34db33fd34db33fd34db33fd34db33fd34db33fd34db33",
+			},
+		},
+		{
+			ref:     "",
+			wantErr: true,
+		},
+		{
+			ref:     "ghcr.io/",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := NewURL(tt.ref)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NewURL(%q) = %+v, want error", tt.ref, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewURL(%q) returned unexpected error: %v", tt.ref, err)
+			}
+			if *got != tt.want {
+				t.Errorf("NewURL(%q) = %+v, want %+v", tt.ref, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURLReference(t *testing.T) {
+	tests := []struct {
+		name string
+		u    URL
+		want string
+	}{
+		{
+			name: "tag only",
+			u:    URL{Version: "3.18"},
+			want: "3.18",
+		},
+		{
+			name: "digest takes precedence over tag",
+			u:    URL{Version: "3.18", Digest: "sha256:abcd"},
+			want: "sha256:abcd",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.u.Reference(); got != tt.want {
+				t.Errorf("Reference() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}